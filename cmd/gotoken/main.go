@@ -4,11 +4,12 @@
 package main
 
 import (
+    "context"
     "fmt"
     "log"
     "net/http"
     "time"
-    
+
     "github.com/couragetogroww/gotoken/pkg/oauth"
 )
 
@@ -23,20 +24,18 @@ func main() {
     
     // Create a token manager that will automatically:
     // 1. Generate a new token with a POST request
-    // 2. Refresh tokens every 59 minutes (before the standard 60-minute expiry)
+    // 2. Refresh it shortly before it expires, based on the expires_in the
+    //    server returned (and issued_at, if the server sets it)
     // 3. Apply tokens to all HTTP requests without additional POST requests
     tokenManager := oauth.NewTokenManager(provider,
-        // Explicitly set refresh time to 59 minutes (this is the default anyway)
-        oauth.WithRefreshTime(59*time.Minute),
-        // Set buffer time (how long before expiry to refresh if not using fixed interval)
+        // Set buffer time (how long before expiry to refresh)
         oauth.WithBufferTime(1*time.Minute),
         // Get notified when a new token is obtained
         oauth.WithOnNewToken(func(token *oauth.TokenResponse) {
-            log.Printf("New token obtained at %s, valid for 60 minutes", time.Now().Format(time.RFC3339))
-            log.Printf("The token will be automatically refreshed in 59 minutes")
+            log.Printf("New token obtained at %s, valid for %d seconds", time.Now().Format(time.RFC3339), token.ExpiresIn)
         }),
     )
-    
+
     // Set up a simple HTTP client that uses the token manager
     client := &http.Client{}
     
@@ -45,14 +44,14 @@ func main() {
     // without needing to generate a new token each time
     makeAuthenticatedRequest := func(url string) {
         // Create a new request
-        req, err := http.NewRequest("GET", url, nil)
+        req, err := http.NewRequestWithContext(context.Background(), "GET", url, nil)
         if err != nil {
             log.Printf("Error creating request: %v", err)
             return
         }
-        
+
         // Wait for a valid token and apply it to the request
-        if err := tokenManager.EnsureValidToken(); err != nil {
+        if err := tokenManager.EnsureValidToken(req.Context()); err != nil {
             log.Printf("Error ensuring valid token: %v", err)
             return
         }
@@ -73,11 +72,11 @@ func main() {
     }
     
     // Print instructions and wait for token initialization
-    fmt.Println("GoToken - 59-Minute OAuth Token Manager")
+    fmt.Println("GoToken - OAuth Token Manager")
     fmt.Println("====================================")
     fmt.Println("This example demonstrates how tokens are automatically:")
     fmt.Println("1. Generated once with a POST request")
-    fmt.Println("2. Refreshed every 59 minutes (before 60-minute expiry)")
+    fmt.Println("2. Refreshed shortly before they expire, based on expires_in")
     fmt.Println("3. Applied to HTTP headers without additional POST requests")
     fmt.Println("\nWaiting for initial token generation...")
     
@@ -94,13 +93,13 @@ func main() {
     makeAuthenticatedRequest("https://httpbin.org/get")
     
     fmt.Println("\nIn a real application, the token would be automatically")
-    fmt.Println("refreshed every 59 minutes without user intervention.")
+    fmt.Println("refreshed shortly before it expires, without user intervention.")
     fmt.Println("Meanwhile, all HTTP requests would continue to receive")
     fmt.Println("the current valid token in their Authorization header.")
-    
+
     // Show how the token will be refreshed in the background
     fmt.Println("\nThis example will now simulate periodic API calls.")
-    fmt.Println("A new token will be automatically generated after 59 minutes.")
+    fmt.Println("A new token will be automatically generated before the current one expires.")
     fmt.Println("Press Ctrl+C to exit.")
     
     // Start a goroutine to periodically make requests to demonstrate
@@ -0,0 +1,272 @@
+// Package oauth provides OAuth token acquisition and management functionality.
+// This file implements the authorization_code (with PKCE) and device_code
+// flows, for applications that need a user to authenticate interactively
+// rather than using client credentials.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// generateCodeVerifier returns a cryptographically random PKCE code_verifier
+// (RFC 7636 section 4.1): 43-128 characters from the unreserved URL-safe set.
+func generateCodeVerifier() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating code verifier: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// challengeFromVerifier derives the S256 PKCE code_challenge from a
+// code_verifier (RFC 7636 section 4.2).
+func challengeFromVerifier(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthorizationCodeProvider implements TokenProvider for the OAuth
+// authorization_code flow with PKCE. Since this flow requires a user to
+// authenticate in a browser, callers must drive BuildAuthURL and Exchange
+// themselves; GetNewToken only returns the token already obtained via
+// Exchange, so a TokenManager can be bootstrapped from it.
+type AuthorizationCodeProvider struct {
+	AuthURL      string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	Scope        string
+	HTTPClient   *http.Client
+
+	mutex        sync.Mutex
+	codeVerifier string
+	lastToken    *TokenResponse
+}
+
+// BuildAuthURL returns the URL the user should be redirected to in order to
+// authorize the client, including a freshly generated PKCE code_challenge.
+// state should be an unguessable value that the caller verifies matches the
+// redirect callback, to protect against CSRF.
+func (p *AuthorizationCodeProvider) BuildAuthURL(state string) string {
+	verifier, err := generateCodeVerifier()
+	if err != nil {
+		// Extremely unlikely (crypto/rand failure); fall back to a URL
+		// without PKCE rather than panicking.
+		verifier = ""
+	}
+
+	p.mutex.Lock()
+	p.codeVerifier = verifier
+	p.mutex.Unlock()
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURI)
+	params.Set("state", state)
+	if p.Scope != "" {
+		params.Set("scope", p.Scope)
+	}
+	if verifier != "" {
+		params.Set("code_challenge", challengeFromVerifier(verifier))
+		params.Set("code_challenge_method", "S256")
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		separator = "&"
+	}
+	return p.AuthURL + separator + params.Encode()
+}
+
+// Exchange trades an authorization code (received via the redirect
+// callback) for a token, presenting the PKCE code_verifier generated by the
+// preceding BuildAuthURL call.
+func (p *AuthorizationCodeProvider) Exchange(ctx context.Context, code string) (*TokenResponse, error) {
+	p.mutex.Lock()
+	verifier := p.codeVerifier
+	p.mutex.Unlock()
+
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("client_id", p.ClientID)
+	data.Set("redirect_uri", p.RedirectURI)
+	if p.ClientSecret != "" {
+		data.Set("client_secret", p.ClientSecret)
+	}
+	if verifier != "" {
+		data.Set("code_verifier", verifier)
+	}
+
+	tokenResp, err := postTokenRequest(ctx, p.TokenURL, data, p.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	p.lastToken = tokenResp
+	p.mutex.Unlock()
+
+	return tokenResp, nil
+}
+
+// GetNewToken implements the TokenProvider interface. It does not perform
+// any network request itself: callers must drive BuildAuthURL and Exchange
+// once to obtain the first token, after which GetNewToken returns it so a
+// TokenManager can bootstrap from it (and hand subsequent refreshes off to a
+// RefreshTokenProvider). ctx is accepted only to satisfy TokenProvider.
+func (p *AuthorizationCodeProvider) GetNewToken(ctx context.Context) (*TokenResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.lastToken == nil {
+		return nil, fmt.Errorf("oauth: no token available, call BuildAuthURL and Exchange first")
+	}
+	return p.lastToken, nil
+}
+
+// deviceAuthResponse is the response from the device authorization endpoint
+// (RFC 8628 section 3.2).
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// DeviceCodeProvider implements TokenProvider for the OAuth device
+// authorization grant (RFC 8628), for input-constrained devices (CLIs, TVs)
+// where the user authenticates on a second device.
+type DeviceCodeProvider struct {
+	DeviceAuthURL string
+	TokenURL      string
+	ClientID      string
+	ClientSecret  string
+	Scope         string
+	HTTPClient    *http.Client
+
+	// OnUserCode is called once the device authorization endpoint has
+	// issued a user_code and verification_uri, so the caller can display
+	// them (or the verification_uri_complete, if present) to the user.
+	OnUserCode func(userCode, verificationURI, verificationURIComplete string)
+}
+
+// GetNewToken implements the TokenProvider interface, driving the full
+// device authorization flow: requesting a device code, surfacing it via
+// OnUserCode, then polling the token endpoint until the user approves (or
+// the device code expires, or ctx is done).
+func (p *DeviceCodeProvider) GetNewToken(ctx context.Context) (*TokenResponse, error) {
+	auth, err := p.requestDeviceAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.OnUserCode != nil {
+		p.OnUserCode(auth.UserCode, auth.VerificationURI, auth.VerificationURIComplete)
+	}
+
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+
+	for {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("oauth: device code expired before user authorized the request")
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		data := url.Values{}
+		data.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+		data.Set("device_code", auth.DeviceCode)
+		data.Set("client_id", p.ClientID)
+		if p.ClientSecret != "" {
+			data.Set("client_secret", p.ClientSecret)
+		}
+
+		tokenResp, err := postTokenRequest(ctx, p.TokenURL, data, p.HTTPClient)
+		if err == nil {
+			return tokenResp, nil
+		}
+
+		tokenErr, ok := err.(*TokenError)
+		if !ok {
+			return nil, err
+		}
+
+		switch tokenErr.Code {
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		case "expired_token":
+			return nil, fmt.Errorf("oauth: device code expired: %v", tokenErr)
+		default:
+			return nil, tokenErr
+		}
+	}
+}
+
+// requestDeviceAuth POSTs to the device authorization endpoint to obtain a
+// device_code and user_code (RFC 8628 section 3.1/3.2).
+func (p *DeviceCodeProvider) requestDeviceAuth(ctx context.Context) (*deviceAuthResponse, error) {
+	data := url.Values{}
+	data.Set("client_id", p.ClientID)
+	if p.Scope != "" {
+		data.Set("scope", p.Scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.DeviceAuthURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating device authorization request: %v", err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	client := p.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending device authorization request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading device authorization response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var auth deviceAuthResponse
+	if err := json.Unmarshal(body, &auth); err != nil {
+		return nil, fmt.Errorf("error parsing device authorization response: %v", err)
+	}
+
+	return &auth, nil
+}
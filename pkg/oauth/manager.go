@@ -1,50 +1,156 @@
 // Package oauth provides OAuth token acquisition and management functionality.
 // This file implements the TokenManager which handles token lifecycle management,
-// refreshing tokens before they expire (typically every 59 minutes for 60-minute tokens)
-// and automatically passing them to HTTP request headers without requiring
+// refreshing tokens shortly before they expire (based on each token's own
+// issued_at/expires_in, unless a fixed refresh interval is configured) and
+// automatically passing them to HTTP request headers without requiring
 // new POST requests for each API call.
 package oauth
 
 import (
+	"context"
 	"log"
+	"math/rand"
 	"net/http"
 	"sync"
 	"time"
 )
 
 // TokenManager handles OAuth token lifecycle management
-// It automatically refreshes tokens before expiry (every 59 minutes for 60-minute tokens)
-// and provides methods to apply tokens to HTTP requests.
+// By default it schedules each refresh from the token's own issued_at and
+// expires_in fields (minus bufferTime), so it adapts to whatever lifetime
+// the provider actually issues; set refreshTime to use a fixed interval
+// instead. It also provides methods to apply tokens to HTTP requests.
 type TokenManager struct {
 	provider     TokenProvider
 	currentToken *TokenResponse
 	mutex        sync.RWMutex
 	refreshTimer *time.Timer
 	tokenReady   chan struct{}
+	err          error         // set if the refresh loop gave up terminally; currentToken keeps any earlier token
 	bufferTime   time.Duration // Time before expiry to refresh the token (default: 1 minute)
-	refreshTime  time.Duration // Time between token refreshes (default: 59 minutes for 60-minute tokens)
+	refreshTime  time.Duration // Fixed time between refreshes; 0 means compute from expires_in/issued_at instead
 	onNewToken   func(token *TokenResponse)
+
+	tokenStore    TokenStore
+	tokenStoreKey string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	scopedMutex  sync.Mutex
+	scopedTokens map[cacheKey]*scopeCacheEntry
+	scopeTTL     time.Duration // Idle time after which an unused scope's cache entry is evicted; 0 disables eviction
+
+	retryPolicy RetryPolicy
+	onError     func(err error)
+
+	invalidated bool // set by Invalidate; makes the next ApplyToRequest call ForceRefresh
+
+	refreshMutex sync.Mutex
+	refreshing   *inflightRefresh // the in-flight ForceRefresh call, if any
+}
+
+// RetryPolicy configures how TokenManager backs off between retries of a
+// failed (retryable) token request: exponential backoff from
+// InitialBackoff up to MaxBackoff, with full jitter (AWS's "Exponential
+// Backoff And Jitter" recipe) to avoid synchronized retries across clients.
+type RetryPolicy struct {
+	InitialBackoff time.Duration // Backoff before the first retry (default: 1 second)
+	MaxBackoff     time.Duration // Ceiling the backoff never exceeds (default: 60 seconds)
+}
+
+// defaultRetryPolicy is used when a TokenManager is created without
+// WithRetryPolicy.
+var defaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     60 * time.Second,
+}
+
+// backoff returns a jittered delay for the given zero-based retry attempt,
+// chosen uniformly at random from [0, min(MaxBackoff, InitialBackoff*2^attempt)].
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultRetryPolicy.InitialBackoff
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryPolicy.MaxBackoff
+	}
+
+	ceiling := maxBackoff
+	// Avoid overflowing the shift for large attempt counts.
+	if attempt < 62 {
+		if scaled := initial * (1 << uint(attempt)); scaled > 0 && scaled < maxBackoff {
+			ceiling = scaled
+		}
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
 }
 
-// NewTokenManager creates a new token manager with the given provider
-// By default, it will refresh tokens every 59 minutes (for 60-minute tokens)
+// NewTokenManager creates a new token manager with the given provider.
+// By default it refreshes each token shortly before it expires, computed
+// from that token's own expires_in (and issued_at, if the provider sets it).
+// It is equivalent to NewTokenManagerWithContext(context.Background(), ...).
 func NewTokenManager(provider TokenProvider, options ...TokenManagerOption) *TokenManager {
+	return NewTokenManagerWithContext(context.Background(), provider, options...)
+}
+
+// NewTokenManagerWithContext creates a new token manager with the given
+// provider, deriving a cancellable context from ctx. Cancelling ctx, or
+// calling the returned manager's Close, stops its refresh loop (and any
+// per-scope refresh goroutines started via GetTokenForScope) and aborts any
+// in-flight token request that respects context cancellation.
+func NewTokenManagerWithContext(ctx context.Context, provider TokenProvider, options ...TokenManagerOption) *TokenManager {
+	managerCtx, cancel := context.WithCancel(ctx)
+
 	tm := &TokenManager{
-		provider:    provider,
-		tokenReady:  make(chan struct{}),
-		bufferTime:  60 * time.Second,     // Default buffer time is 60 seconds
-		refreshTime: 59 * time.Minute,     // Default refresh time is 59 minutes (for 60-minute tokens)
+		provider:     provider,
+		tokenReady:   make(chan struct{}),
+		bufferTime:   60 * time.Second, // Default buffer time is 60 seconds
+		ctx:          managerCtx,
+		cancel:       cancel,
+		scopedTokens: make(map[cacheKey]*scopeCacheEntry),
+		retryPolicy:  defaultRetryPolicy,
 	}
-   
+
 	// Apply options
 	for _, option := range options {
 		option(tm)
 	}
-   
+
 	go tm.run()
 	return tm
 }
 
+// Close stops the refresh loop and any per-scope refresh goroutines, and
+// cancels the context passed to any in-flight token request. It is safe to
+// call more than once.
+func (tm *TokenManager) Close() error {
+	tm.cancel()
+
+	tm.mutex.Lock()
+	if tm.refreshTimer != nil {
+		tm.refreshTimer.Stop()
+	}
+	tm.mutex.Unlock()
+
+	tm.scopedMutex.Lock()
+	for _, entry := range tm.scopedTokens {
+		entry.mutex.Lock()
+		select {
+		case <-entry.stop:
+		default:
+			close(entry.stop)
+		}
+		entry.mutex.Unlock()
+	}
+	tm.scopedMutex.Unlock()
+
+	return nil
+}
+
 // TokenManagerOption defines a function type for configuring the TokenManager
 type TokenManagerOption func(*TokenManager)
 
@@ -55,8 +161,10 @@ func WithBufferTime(duration time.Duration) TokenManagerOption {
 	}
 }
 
-// WithRefreshTime sets a custom refresh time for tokens
-// For 60-minute tokens, the recommended value is 59 minutes
+// WithRefreshTime sets a fixed interval between token refreshes, overriding
+// the default of computing each refresh from the token's own expires_in and
+// issued_at. Only use this if the provider's tokens don't carry reliable
+// expiry information.
 func WithRefreshTime(duration time.Duration) TokenManagerOption {
 	return func(tm *TokenManager) {
 		tm.refreshTime = duration
@@ -70,31 +178,142 @@ func WithOnNewToken(callback func(token *TokenResponse)) TokenManagerOption {
 	}
 }
 
+// WithScopeTTL sets how long a per-scope cache entry (see GetTokenForScope)
+// may go unused before its background refresh goroutine is stopped and it
+// is evicted. Idleness is only checked when the entry's refresh is due, so
+// an idle entry is evicted at its first scheduled refresh after the TTL has
+// passed, not at the moment the TTL runs out. The default, 0, never evicts.
+func WithScopeTTL(duration time.Duration) TokenManagerOption {
+	return func(tm *TokenManager) {
+		tm.scopeTTL = duration
+	}
+}
+
+// WithRetryPolicy sets the backoff policy used between retries of a failed
+// token request. The default is 1s initial / 60s max.
+func WithRetryPolicy(policy RetryPolicy) TokenManagerOption {
+	return func(tm *TokenManager) {
+		tm.retryPolicy = policy
+	}
+}
+
+// WithOnError sets a callback invoked when a token request fails with a
+// non-retryable error (any 4xx other than 429), after which the manager
+// stops refreshing rather than retrying a request that can't succeed.
+func WithOnError(callback func(err error)) TokenManagerOption {
+	return func(tm *TokenManager) {
+		tm.onError = callback
+	}
+}
+
+// WithTokenStore configures tm to load a previously-persisted token for key
+// on startup (skipping the initial POST if it's still valid) and to Save
+// the token back to store after every refresh. This is essential for CLI
+// tools and other short-lived processes that would otherwise force a
+// re-auth on every invocation.
+func WithTokenStore(store TokenStore, key string) TokenManagerOption {
+	return func(tm *TokenManager) {
+		tm.tokenStore = store
+		tm.tokenStoreKey = key
+	}
+}
+
+// signalReady closes tm.tokenReady if it isn't already closed, marking the
+// current token as available to waiters. Callers must hold tm.mutex; this
+// is the only place tm.tokenReady is ever closed, so run's scheduled
+// refreshes and a concurrent ForceRefresh can never race to close it twice.
+func (tm *TokenManager) signalReady() {
+	select {
+	case <-tm.tokenReady:
+	default:
+		close(tm.tokenReady)
+	}
+}
+
 // run starts the token refresh loop
-// This continuously monitors token expiration and automatically refreshes tokens
-// before they expire, by default at 59 minutes for 60-minute tokens.
+// This continuously monitors token expiration and automatically refreshes
+// tokens before they expire, by default scheduling each refresh from that
+// token's own issued_at/expires_in. It exits once tm.ctx is done.
 func (tm *TokenManager) run() {
+	attempt := 0
+	tryLoad := tm.tokenStore != nil
+
 	for {
-		// Generate a new token with a POST request
-		token, err := tm.provider.GetNewToken()
+		if tm.ctx.Err() != nil {
+			return
+		}
+
+		var token *TokenResponse
+		fromStore := false
+
+		if tryLoad {
+			tryLoad = false
+			loaded, loadErr := tm.tokenStore.Load(tm.tokenStoreKey)
+			if loadErr != nil {
+				log.Printf("Error loading persisted token: %v", loadErr)
+			} else if tokenStillValid(loaded) {
+				token, fromStore = loaded, true
+			}
+		}
+
+		var err error
+		if token == nil {
+			// Generate a new token with a POST request
+			token, err = tm.provider.GetNewToken(tm.ctx)
+		}
 		if err != nil {
-			log.Printf("Error refreshing token: %v", err)
-			time.Sleep(5 * time.Second)
+			if tm.ctx.Err() != nil {
+				return
+			}
+
+			if !IsRetryable(err) {
+				log.Printf("Token request failed with a non-retryable error, giving up: %v", err)
+				if tm.onError != nil {
+					tm.onError(err)
+				}
+
+				// Record the terminal error and wake any caller blocked in
+				// WaitForToken/EnsureValidToken, so it gets this error back
+				// instead of hanging forever (mirrors the scope cache's
+				// handling of a terminal first-fetch error).
+				tm.mutex.Lock()
+				tm.err = err
+				tm.signalReady()
+				tm.mutex.Unlock()
+				return
+			}
+
+			wait := retryAfterOf(err)
+			if wait <= 0 {
+				wait = tm.retryPolicy.backoff(attempt)
+			}
+			attempt++
+			log.Printf("Error refreshing token (attempt %d): %v; retrying in %v", attempt, err, wait)
+
+			select {
+			case <-time.After(wait):
+			case <-tm.ctx.Done():
+				return
+			}
 			continue
 		}
+		attempt = 0
 
-		// Update the current token securely
+		if !fromStore && tm.tokenStore != nil {
+			if saveErr := tm.tokenStore.Save(tm.tokenStoreKey, token); saveErr != nil {
+				log.Printf("Error persisting token: %v", saveErr)
+			}
+		}
+
+		// Update the current token securely and signal that it's ready for
+		// use, all under one lock so this can't race with a concurrent
+		// ForceRefresh also signaling readiness.
 		tm.mutex.Lock()
 		tm.currentToken = token
+		tm.err = nil
+		tm.signalReady()
 		tm.mutex.Unlock()
 
-		// Signal that the token is ready for use in HTTP headers
-		select {
-		case <-tm.tokenReady:
-		default:
-			close(tm.tokenReady)
-		}
-	   
 		// Call the onNewToken callback if set
 		if tm.onNewToken != nil {
 			tm.onNewToken(token)
@@ -103,23 +322,28 @@ func (tm *TokenManager) run() {
 		// Determine when to refresh the token
 		var refreshTime time.Duration
 		if tm.refreshTime > 0 {
-			// Use the explicit refresh time (default 59 minutes)
+			// Use the explicit fixed refresh interval
 			refreshTime = tm.refreshTime
 			log.Printf("Token will be refreshed in %v (using fixed refresh interval)", refreshTime)
 		} else {
-			// Calculate based on token's expiry minus buffer time
-			refreshTime = time.Duration(token.ExpiresIn)*time.Second - tm.bufferTime
-			if refreshTime < 0 {
-				refreshTime = 5 * time.Second // If token is about to expire, refresh soon
-			}
+			// Calculate based on the token's own issued_at/expires_in minus buffer time
+			refreshTime = nextRefreshTime(token, tm.bufferTime)
 			log.Printf("Token will be refreshed in %v (using token expiry time)", refreshTime)
 		}
 	   
 		// Wait until it's time to refresh
+		tm.mutex.Lock()
 		tm.refreshTimer = time.NewTimer(refreshTime)
-		<-tm.refreshTimer.C
-		log.Printf("Refreshing token after %v", refreshTime)
-	   
+		timer := tm.refreshTimer
+		tm.mutex.Unlock()
+
+		select {
+		case <-timer.C:
+			log.Printf("Refreshing token after %v", refreshTime)
+		case <-tm.ctx.Done():
+			return
+		}
+
 		// Create a new tokenReady channel for the next token
 		tm.mutex.Lock()
 		tm.tokenReady = make(chan struct{})
@@ -127,6 +351,62 @@ func (tm *TokenManager) run() {
 	}
 }
 
+// minRefreshInterval is the floor below which we never schedule a refresh,
+// to avoid hammering the token endpoint for very short-lived tokens.
+const minRefreshInterval = 5 * time.Second
+
+// defaultNoExpiryRefreshInterval is used when a token carries no expires_in
+// at all (some OCI/Docker bearer-token servers omit it). Treating a missing
+// expires_in as "expires immediately" would otherwise collapse to
+// minRefreshInterval and re-POST the token endpoint every few seconds
+// forever, so instead we fall back to a conservative fixed interval; set
+// WithRefreshTime explicitly if a provider needs something different.
+const defaultNoExpiryRefreshInterval = 59 * time.Minute
+
+// retryAfterOf returns the server-requested delay from a 429 response's
+// Retry-After header, or 0 if err doesn't carry one.
+func retryAfterOf(err error) time.Duration {
+	tokenErr, ok := err.(*TokenError)
+	if !ok {
+		return 0
+	}
+	return tokenErr.RetryAfter
+}
+
+// nextRefreshTime computes how long to wait before refreshing token, based
+// on its own expires_in (and issued_at, if the provider set it) rather than
+// a fixed interval. A token with no expires_in at all falls back to
+// defaultNoExpiryRefreshInterval. Tokens shorter than 60 seconds are
+// refreshed at their halfway point instead of expiry-minus-buffer, since the
+// buffer alone could otherwise exceed their entire lifetime.
+func nextRefreshTime(token *TokenResponse, bufferTime time.Duration) time.Duration {
+	if token.ExpiresIn <= 0 {
+		return defaultNoExpiryRefreshInterval
+	}
+
+	expiresIn := time.Duration(token.ExpiresIn) * time.Second
+
+	if expiresIn < 60*time.Second {
+		half := expiresIn / 2
+		if half < minRefreshInterval {
+			half = minRefreshInterval
+		}
+		return half
+	}
+
+	issuedAt := token.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+
+	refreshAt := issuedAt.Add(expiresIn).Add(-bufferTime)
+	remaining := time.Until(refreshAt)
+	if remaining < minRefreshInterval {
+		remaining = minRefreshInterval
+	}
+	return remaining
+}
+
 // WaitForToken blocks until a token is available
 func (tm *TokenManager) WaitForToken() {
 	<-tm.tokenReady
@@ -149,10 +429,23 @@ func (tm *TokenManager) GetFullToken() *TokenResponse {
 	return tm.currentToken
 }
 
-// EnsureValidToken ensures a valid token is available
-func (tm *TokenManager) EnsureValidToken() error {
-	tm.WaitForToken()
-	return nil
+// EnsureValidToken blocks until a valid token is available or ctx is done,
+// whichever happens first. If the refresh loop gave up with a terminal
+// error (on the first fetch or on a later refresh), that error is returned
+// instead.
+func (tm *TokenManager) EnsureValidToken(ctx context.Context) error {
+	tm.mutex.RLock()
+	ready := tm.tokenReady
+	tm.mutex.RUnlock()
+
+	select {
+	case <-ready:
+		tm.mutex.RLock()
+		defer tm.mutex.RUnlock()
+		return tm.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // GetAuthorizationHeader returns a complete authorization header value
@@ -164,8 +457,21 @@ func (tm *TokenManager) GetAuthorizationHeader() string {
 	return token.TokenType + " " + token.AccessToken
 }
 
-// ApplyToRequest adds the authorization header to an HTTP request
+// ApplyToRequest adds the authorization header to an HTTP request. If the
+// current token has been marked stale via Invalidate, it first calls
+// ForceRefresh (deduplicated against any refresh already in flight from
+// another goroutine) so the request goes out with a live token.
 func (tm *TokenManager) ApplyToRequest(req *http.Request) {
+	tm.mutex.RLock()
+	invalidated := tm.invalidated
+	tm.mutex.RUnlock()
+
+	if invalidated {
+		if err := tm.ForceRefresh(req.Context()); err != nil {
+			log.Printf("Error force-refreshing invalidated token: %v", err)
+		}
+	}
+
 	authHeader := tm.GetAuthorizationHeader()
 	if authHeader != "" {
 		req.Header.Set("Authorization", authHeader)
@@ -0,0 +1,86 @@
+// Package oauth provides OAuth token acquisition and management functionality.
+// This file implements TokenManager's on-demand refresh path: ForceRefresh
+// lets a caller (typically Transport, after a 401) fetch a fresh token
+// outside of the scheduled refresh loop, while de-duplicating concurrent
+// callers so a burst of simultaneous requests results in a single POST to
+// the token endpoint rather than one per caller.
+package oauth
+
+import (
+	"context"
+	"log"
+)
+
+// inflightRefresh tracks a single in-flight ForceRefresh call so that
+// concurrent callers all wait on, and receive, its result instead of each
+// starting their own request to the token endpoint.
+type inflightRefresh struct {
+	done  chan struct{}
+	token *TokenResponse
+	err   error
+}
+
+// ForceRefresh fetches a fresh token from tm's provider immediately,
+// bypassing the scheduled refresh loop, and installs it as the current
+// token on success. If a ForceRefresh is already in flight, the call joins
+// it instead of starting a second request, and returns that call's result
+// once it completes; this keeps a burst of callers (e.g. every goroutine
+// that just saw a 401 on the same expired token) from each firing their own
+// POST to the IdP.
+func (tm *TokenManager) ForceRefresh(ctx context.Context) error {
+	tm.refreshMutex.Lock()
+	if inflight := tm.refreshing; inflight != nil {
+		tm.refreshMutex.Unlock()
+		select {
+		case <-inflight.done:
+			return inflight.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	inflight := &inflightRefresh{done: make(chan struct{})}
+	tm.refreshing = inflight
+	tm.refreshMutex.Unlock()
+
+	token, err := tm.provider.GetNewToken(ctx)
+	if err == nil {
+		if tm.tokenStore != nil {
+			if saveErr := tm.tokenStore.Save(tm.tokenStoreKey, token); saveErr != nil {
+				log.Printf("Error persisting token: %v", saveErr)
+			}
+		}
+
+		tm.mutex.Lock()
+		tm.currentToken = token
+		tm.invalidated = false
+		tm.err = nil
+		tm.signalReady()
+		tm.mutex.Unlock()
+
+		if tm.onNewToken != nil {
+			tm.onNewToken(token)
+		}
+	}
+
+	inflight.token, inflight.err = token, err
+	close(inflight.done)
+
+	tm.refreshMutex.Lock()
+	if tm.refreshing == inflight {
+		tm.refreshing = nil
+	}
+	tm.refreshMutex.Unlock()
+
+	return err
+}
+
+// Invalidate marks the current token as stale, without blocking to fetch a
+// replacement. The next call to ApplyToRequest will call ForceRefresh before
+// using it. This is meant for callers that learn a token was rejected (e.g.
+// Transport seeing a 401) outside of the manager's own refresh loop.
+func (tm *TokenManager) Invalidate() {
+	tm.mutex.Lock()
+	tm.invalidated = true
+	tm.mutex.Unlock()
+}
@@ -0,0 +1,248 @@
+// Package oauth provides OAuth token acquisition and management functionality.
+// This file implements TokenManager's per-scope token cache: in addition to
+// the single "current token" tracked by manager.go, TokenManager keeps an
+// independent, independently-refreshed token for every distinct
+// (scope, audience, resource) tuple an application requests, mirroring how
+// docker/distribution's tokenHandler tracks additional scopes.
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cacheKey identifies a per-scope cache entry. Audience and Resource are
+// reserved for providers that support them; GetTokenForScope currently only
+// varies Scope.
+type cacheKey struct {
+	Scope    string
+	Audience string
+	Resource string
+}
+
+// ScopedProvider is implemented by providers that can mint a token for an
+// explicit scope, distinct from whatever scope they were constructed with.
+// TokenManager's scope cache uses it when the configured provider supports
+// it; providers that don't implement it can still be used, but every scope's
+// entry fetches its token with GetNewToken, i.e. for the provider's
+// statically-configured scope.
+type ScopedProvider interface {
+	GetTokenForScope(ctx context.Context, scope string) (*TokenResponse, error)
+}
+
+// scopeCacheEntry holds the cached token and refresh state for a single
+// cacheKey, guarded by its own mutex so scopes refresh independently.
+type scopeCacheEntry struct {
+	mutex        sync.RWMutex
+	currentToken *TokenResponse
+	err          error // set if a fetch for this entry failed terminally, whether the first fetch or a later refresh
+	tokenReady   chan struct{}
+	refreshTimer *time.Timer
+	lastAccess   time.Time
+	stop         chan struct{}
+}
+
+// signalReady closes e.tokenReady if it isn't already closed. Callers must
+// hold e.mutex.
+func (e *scopeCacheEntry) signalReady() {
+	select {
+	case <-e.tokenReady:
+	default:
+		close(e.tokenReady)
+	}
+}
+
+// GetTokenForScope returns the access token for scope, fetching and caching
+// one (and starting an independent refresh goroutine for it) the first time
+// that scope is requested. It blocks until the first token for scope is
+// available, or ctx is done.
+func (tm *TokenManager) GetTokenForScope(ctx context.Context, scope string) (string, error) {
+	token, err := tm.tokenForScope(ctx, cacheKey{Scope: scope})
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// ApplyToRequestWithScope adds an Authorization header built from the
+// cached token for scope (fetching it if this is the first request for that
+// scope) to req, using req.Context() for cancellation.
+func (tm *TokenManager) ApplyToRequestWithScope(req *http.Request, scope string) error {
+	token, err := tm.tokenForScope(req.Context(), cacheKey{Scope: scope})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", token.TokenType+" "+token.AccessToken)
+	return nil
+}
+
+// tokenForScope returns the current (or first) token cached for key,
+// creating its cache entry and background refresh goroutine if needed.
+func (tm *TokenManager) tokenForScope(ctx context.Context, key cacheKey) (*TokenResponse, error) {
+	entry := tm.scopeEntry(key)
+
+	entry.mutex.RLock()
+	token := entry.currentToken
+	ready := entry.tokenReady
+	entry.mutex.RUnlock()
+
+	if token == nil {
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	entry.mutex.Lock()
+	entry.lastAccess = time.Now()
+	token = entry.currentToken
+	fetchErr := entry.err
+	entry.mutex.Unlock()
+
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if token == nil {
+		return nil, fmt.Errorf("oauth: no token available for scope %q", key.Scope)
+	}
+	return token, nil
+}
+
+// scopeEntry returns the cache entry for key, creating it (and spawning its
+// refresh goroutine) if this is the first time key has been requested.
+func (tm *TokenManager) scopeEntry(key cacheKey) *scopeCacheEntry {
+	tm.scopedMutex.Lock()
+	defer tm.scopedMutex.Unlock()
+
+	entry, ok := tm.scopedTokens[key]
+	if ok {
+		return entry
+	}
+
+	entry = &scopeCacheEntry{
+		tokenReady: make(chan struct{}),
+		stop:       make(chan struct{}),
+		lastAccess: time.Now(),
+	}
+	tm.scopedTokens[key] = entry
+	go tm.runScope(key, entry)
+	return entry
+}
+
+// runScope is the per-scope analogue of TokenManager.run: it fetches a
+// token for key, schedules its own refresh from that token's expiry, and
+// evicts itself from scopedTokens if it goes unused for longer than
+// tm.scopeTTL.
+func (tm *TokenManager) runScope(key cacheKey, entry *scopeCacheEntry) {
+	attempt := 0
+	for {
+		if tm.ctx.Err() != nil {
+			return
+		}
+
+		token, err := tm.fetchTokenForScope(key)
+		if err != nil {
+			if tm.ctx.Err() != nil {
+				return
+			}
+
+			if !IsRetryable(err) {
+				log.Printf("Token request for scope %q failed with a non-retryable error, giving up: %v", key.Scope, err)
+				if tm.onError != nil {
+					tm.onError(err)
+				}
+
+				// Record the terminal error and wake any caller blocked on
+				// tokenForScope's first fetch, so it gets this error back
+				// instead of hanging until its context expires.
+				entry.mutex.Lock()
+				entry.err = err
+				entry.signalReady()
+				entry.mutex.Unlock()
+
+				tm.evictScope(key, entry)
+				return
+			}
+
+			wait := retryAfterOf(err)
+			if wait <= 0 {
+				wait = tm.retryPolicy.backoff(attempt)
+			}
+			attempt++
+			log.Printf("Error refreshing token for scope %q (attempt %d): %v; retrying in %v", key.Scope, attempt, err, wait)
+
+			select {
+			case <-time.After(wait):
+			case <-entry.stop:
+				return
+			case <-tm.ctx.Done():
+				return
+			}
+			continue
+		}
+		attempt = 0
+
+		entry.mutex.Lock()
+		entry.currentToken = token
+		entry.signalReady()
+		entry.mutex.Unlock()
+
+		if tm.onNewToken != nil {
+			tm.onNewToken(token)
+		}
+
+		refreshTime := nextRefreshTime(token, tm.bufferTime)
+
+		entry.mutex.Lock()
+		entry.refreshTimer = time.NewTimer(refreshTime)
+		timer := entry.refreshTimer
+		entry.mutex.Unlock()
+
+		select {
+		case <-timer.C:
+		case <-entry.stop:
+			return
+		case <-tm.ctx.Done():
+			return
+		}
+
+		entry.mutex.Lock()
+		idle := tm.scopeTTL > 0 && time.Since(entry.lastAccess) >= tm.scopeTTL
+		if !idle {
+			entry.tokenReady = make(chan struct{})
+		}
+		entry.mutex.Unlock()
+
+		if idle {
+			tm.evictScope(key, entry)
+			return
+		}
+	}
+}
+
+// fetchTokenForScope fetches a fresh token for key from the manager's
+// provider, using GetTokenForScope when the provider implements
+// ScopedProvider and falling back to its statically-configured scope
+// otherwise.
+func (tm *TokenManager) fetchTokenForScope(key cacheKey) (*TokenResponse, error) {
+	if scoped, ok := tm.provider.(ScopedProvider); ok {
+		return scoped.GetTokenForScope(tm.ctx, key.Scope)
+	}
+	return tm.provider.GetNewToken(tm.ctx)
+}
+
+// evictScope removes key's cache entry, but only if it is still the entry
+// that was passed in (it may already have been replaced by a concurrent
+// request that arrived just as this goroutine decided to evict).
+func (tm *TokenManager) evictScope(key cacheKey, entry *scopeCacheEntry) {
+	tm.scopedMutex.Lock()
+	defer tm.scopedMutex.Unlock()
+	if tm.scopedTokens[key] == entry {
+		delete(tm.scopedTokens, key)
+	}
+}
@@ -0,0 +1,32 @@
+// Package oauth provides OAuth token acquisition and management functionality.
+// This file defines the TokenStore interface TokenManager uses to persist
+// tokens across process restarts; implementations live in pkg/oauth/store.
+package oauth
+
+import "time"
+
+// TokenStore persists tokens across process restarts, keyed by an
+// application-chosen string (e.g. a provider name or scope). Load should
+// return a nil TokenResponse and nil error when key has never been saved.
+type TokenStore interface {
+	Load(key string) (*TokenResponse, error)
+	Save(key string, token *TokenResponse) error
+	Delete(key string) error
+}
+
+// tokenStillValid reports whether token is usable without a refresh: it has
+// an access token and, if it carries expiry information, has not yet
+// expired. A token with expires_in but no issued_at is reported as not
+// valid, since its age can't be known.
+func tokenStillValid(token *TokenResponse) bool {
+	if token == nil || token.AccessToken == "" {
+		return false
+	}
+	if token.ExpiresIn <= 0 {
+		return true
+	}
+	if token.IssuedAt.IsZero() {
+		return false
+	}
+	return time.Now().Before(token.IssuedAt.Add(time.Duration(token.ExpiresIn) * time.Second))
+}
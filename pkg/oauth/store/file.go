@@ -0,0 +1,114 @@
+// Package store provides oauth.TokenStore implementations for persisting
+// TokenManager's tokens across process restarts.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/couragetogroww/gotoken/pkg/oauth"
+)
+
+// File is a file-backed oauth.TokenStore that persists each key's token as
+// a JSON file under Dir. It's meant for CLI tools and other short-lived
+// processes that would otherwise force a re-auth on every invocation.
+type File struct {
+	Dir string
+
+	mutex sync.Mutex
+}
+
+// NewFile creates a File-backed token store rooted at dir, creating dir
+// (and any missing parents) with owner-only permissions if it doesn't
+// already exist.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating token store directory: %v", err)
+	}
+	return &File{Dir: dir}, nil
+}
+
+// path returns the file key is stored under, rejecting any key that would
+// escape Dir (path separators, "..", or an empty string) so a
+// caller-controlled key can't be used for path traversal or to clobber an
+// unrelated file.
+func (f *File) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("oauth: invalid token store key %q", key)
+	}
+	return filepath.Join(f.Dir, key+".json"), nil
+}
+
+// Load implements oauth.TokenStore.
+func (f *File) Load(key string) (*oauth.TokenResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading token file: %v", err)
+	}
+
+	var token oauth.TokenResponse
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("error parsing token file: %v", err)
+	}
+	return &token, nil
+}
+
+// Save implements oauth.TokenStore. It writes to a temporary file and
+// renames it into place so a crash mid-write can't leave a corrupt token
+// file behind.
+func (f *File) Save(key string, token *oauth.TokenResponse) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding token: %v", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("error writing token file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error saving token file: %v", err)
+	}
+	return nil
+}
+
+// Delete implements oauth.TokenStore.
+func (f *File) Delete(key string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
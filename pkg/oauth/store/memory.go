@@ -0,0 +1,54 @@
+// Package store provides oauth.TokenStore implementations for persisting
+// TokenManager's tokens across process restarts.
+package store
+
+import (
+	"sync"
+
+	"github.com/couragetogroww/gotoken/pkg/oauth"
+)
+
+// Memory is an in-memory oauth.TokenStore. It doesn't survive a process
+// restart, so it's mainly useful for tests or for sharing a token between
+// TokenManagers within the same process.
+type Memory struct {
+	mutex  sync.RWMutex
+	tokens map[string]*oauth.TokenResponse
+}
+
+// NewMemory creates an empty in-memory token store.
+func NewMemory() *Memory {
+	return &Memory{tokens: make(map[string]*oauth.TokenResponse)}
+}
+
+// Load implements oauth.TokenStore.
+func (m *Memory) Load(key string) (*oauth.TokenResponse, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	token, ok := m.tokens[key]
+	if !ok {
+		return nil, nil
+	}
+	stored := *token
+	return &stored, nil
+}
+
+// Save implements oauth.TokenStore.
+func (m *Memory) Save(key string, token *oauth.TokenResponse) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored := *token
+	m.tokens[key] = &stored
+	return nil
+}
+
+// Delete implements oauth.TokenStore.
+func (m *Memory) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.tokens, key)
+	return nil
+}
@@ -4,25 +4,106 @@
 package oauth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // TokenResponse represents a generic OAuth token response
 type TokenResponse struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	TokenType   string `json:"token_type"`
-	Scope       string `json:"scope,omitempty"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpiresIn    int       `json:"expires_in"`
+	TokenType    string    `json:"token_type"`
+	Scope        string    `json:"scope,omitempty"`
+	IssuedAt     time.Time `json:"issued_at,omitempty"`
+}
+
+// tokenResponseAlias has the same fields as TokenResponse but without its
+// UnmarshalJSON method, so UnmarshalJSON can decode into it without
+// recursing.
+type tokenResponseAlias TokenResponse
+
+// UnmarshalJSON implements json.Unmarshaler. Besides the standard
+// "access_token" field, it also accepts a bare "token" field, as returned by
+// the Docker/OCI distribution bearer-token spec.
+func (t *TokenResponse) UnmarshalJSON(data []byte) error {
+	var alias struct {
+		tokenResponseAlias
+		Token string `json:"token,omitempty"`
+	}
+
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+
+	*t = TokenResponse(alias.tokenResponseAlias)
+	if t.AccessToken == "" {
+		t.AccessToken = alias.Token
+	}
+
+	return nil
 }
 
 // TokenProvider defines the interface for getting a new OAuth token
 type TokenProvider interface {
-	GetNewToken() (*TokenResponse, error)
+	GetNewToken(ctx context.Context) (*TokenResponse, error)
+}
+
+// tokenErrorResponse captures the standard OAuth2 error body
+// (RFC 6749 section 5.2), e.g. {"error": "invalid_grant", ...}.
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// TokenError represents a failed OAuth2 token request, carrying the
+// HTTP status code and the server's error code (e.g. "invalid_grant")
+// so callers can decide whether to retry or fall back to another grant.
+type TokenError struct {
+	StatusCode int
+	Code       string
+	Body       string
+	// RetryAfter is populated from a 429 response's Retry-After header
+	// (seconds form only), and is zero if the server didn't send one.
+	RetryAfter time.Duration
+}
+
+func (e *TokenError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("oauth token error: %s (status %d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("oauth token error: status %d, body: %s", e.StatusCode, e.Body)
+}
+
+// IsInvalidGrant reports whether err is a TokenError for an expired or
+// revoked grant (refresh token, authorization code, etc).
+func IsInvalidGrant(err error) bool {
+	tokenErr, ok := err.(*TokenError)
+	return ok && tokenErr.Code == "invalid_grant"
+}
+
+// IsRetryable classifies err to decide whether TokenManager should back off
+// and retry, or fail fast. Network errors and 5xx/429 responses are
+// retryable; other 4xx responses (bad client_id, invalid_grant, etc.) are
+// not, since retrying them just repeats the same failure.
+func IsRetryable(err error) bool {
+	tokenErr, ok := err.(*TokenError)
+	if !ok {
+		// Errors creating the request or reaching the server at all.
+		return true
+	}
+	if tokenErr.StatusCode == http.StatusTooManyRequests || tokenErr.StatusCode >= 500 {
+		return true
+	}
+	return tokenErr.StatusCode < 400
 }
 
 // ClientCredentialsProvider implements TokenProvider for the OAuth client credentials flow
@@ -36,29 +117,45 @@ type ClientCredentialsProvider struct {
 }
 
 // GetNewToken implements the TokenProvider interface for client credentials flow
-func (p *ClientCredentialsProvider) GetNewToken() (*TokenResponse, error) {
+func (p *ClientCredentialsProvider) GetNewToken(ctx context.Context) (*TokenResponse, error) {
 	data := url.Values{}
 	data.Set("grant_type", "client_credentials")
 	data.Set("client_id", p.ClientID)
 	data.Set("client_secret", p.ClientSecret)
-   
+
 	if p.Scope != "" {
 		data.Set("scope", p.Scope)
 	}
-   
+
 	// Add any extra parameters
 	for key, value := range p.ExtraParams {
 		data.Set(key, value)
 	}
 
-	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(data.Encode()))
+	return postTokenRequest(ctx, p.TokenURL, data, p.HTTPClient)
+}
+
+// GetTokenForScope implements ScopedProvider, letting TokenManager's
+// per-scope cache mint a token for an explicit scope rather than the one
+// p was configured with.
+func (p *ClientCredentialsProvider) GetTokenForScope(ctx context.Context, scope string) (*TokenResponse, error) {
+	clone := *p
+	clone.Scope = scope
+	return clone.GetNewToken(ctx)
+}
+
+// postTokenRequest POSTs a form-encoded token request to tokenURL and parses
+// the result, returning a *TokenError (rather than a plain error) on non-200
+// responses so callers can inspect the OAuth2 error code.
+func postTokenRequest(ctx context.Context, tokenURL string, data url.Values, httpClient *http.Client) (*TokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("error creating token request: %v", err)
 	}
 
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	client := p.HTTPClient
+	client := httpClient
 	if client == nil {
 		client = &http.Client{}
 	}
@@ -69,13 +166,23 @@ func (p *ClientCredentialsProvider) GetNewToken() (*TokenResponse, error) {
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading token response: %v", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+		tokenErr := &TokenError{StatusCode: resp.StatusCode, Body: string(body)}
+		var errResp tokenErrorResponse
+		if jsonErr := json.Unmarshal(body, &errResp); jsonErr == nil {
+			tokenErr.Code = errResp.Error
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				tokenErr.RetryAfter = time.Duration(secs) * time.Second
+			}
+		}
+		return nil, tokenErr
 	}
 
 	var tokenResp TokenResponse
@@ -86,3 +193,103 @@ func (p *ClientCredentialsProvider) GetNewToken() (*TokenResponse, error) {
 
 	return &tokenResp, nil
 }
+
+// CredentialStore is implemented by providers that can persist a rotating
+// refresh token between calls, mirroring docker/distribution's
+// auth.CredentialStore interface.
+type CredentialStore interface {
+	RefreshToken() string
+	SetRefreshToken(token string)
+}
+
+// RefreshTokenProvider implements TokenProvider using the OAuth2
+// refresh_token grant. It stores the current refresh token in memory and
+// rotates it whenever the server returns a new one. If no refresh token is
+// held yet, or the server rejects the current one with "invalid_grant",
+// GetNewToken falls back to Fallback (typically a ClientCredentialsProvider
+// or one of the interactive flow providers) to bootstrap a fresh grant.
+type RefreshTokenProvider struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+	// Fallback is used to obtain an initial token when no refresh token is
+	// held, and to re-bootstrap after the refresh token is rejected.
+	Fallback TokenProvider
+
+	mutex        sync.Mutex
+	refreshToken string
+}
+
+// RefreshToken returns the currently held refresh token, implementing
+// CredentialStore.
+func (p *RefreshTokenProvider) RefreshToken() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.refreshToken
+}
+
+// SetRefreshToken stores a refresh token to be used on the next GetNewToken
+// call, implementing CredentialStore.
+func (p *RefreshTokenProvider) SetRefreshToken(token string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.refreshToken = token
+}
+
+// GetNewToken implements the TokenProvider interface, preferring the
+// refresh_token grant when a refresh token is held and falling back to
+// Fallback otherwise (or when the held refresh token is rejected).
+func (p *RefreshTokenProvider) GetNewToken(ctx context.Context) (*TokenResponse, error) {
+	refreshToken := p.RefreshToken()
+	if refreshToken == "" {
+		return p.bootstrap(ctx)
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", refreshToken)
+	data.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		data.Set("client_secret", p.ClientSecret)
+	}
+
+	tokenResp, err := postTokenRequest(ctx, p.TokenURL, data, p.HTTPClient)
+	if err != nil {
+		if IsInvalidGrant(err) {
+			// The refresh token has been revoked or expired; drop it and
+			// re-bootstrap from the fallback provider.
+			p.SetRefreshToken("")
+			return p.bootstrap(ctx)
+		}
+		return nil, err
+	}
+
+	// The server may rotate the refresh token; persist whatever it returns,
+	// including re-issuing the same one, so SetRefreshToken is the single
+	// source of truth for the next refresh.
+	if tokenResp.RefreshToken != "" {
+		p.SetRefreshToken(tokenResp.RefreshToken)
+	}
+
+	return tokenResp, nil
+}
+
+// bootstrap obtains a token from Fallback and, if it came with a refresh
+// token, stores it for subsequent refresh_token grants.
+func (p *RefreshTokenProvider) bootstrap(ctx context.Context) (*TokenResponse, error) {
+	if p.Fallback == nil {
+		return nil, fmt.Errorf("oauth: no refresh token held and no fallback provider configured")
+	}
+
+	tokenResp, err := p.Fallback.GetNewToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenResp.RefreshToken != "" {
+		p.SetRefreshToken(tokenResp.RefreshToken)
+	}
+
+	return tokenResp, nil
+}
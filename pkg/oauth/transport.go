@@ -0,0 +1,123 @@
+// Package oauth provides OAuth token acquisition and management functionality.
+// This file adapts TokenManager to the standard http.RoundTripper interface
+// (and to the shape of golang.org/x/oauth2's TokenSource), so it can be
+// dropped into an http.Client or any library built around those interfaces
+// without the caller manually calling EnsureValidToken/ApplyToRequest.
+package oauth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// transport implements http.RoundTripper, injecting tm's current bearer
+// token into every request.
+type transport struct {
+	base http.RoundTripper
+	tm   *TokenManager
+}
+
+// Transport returns an http.RoundTripper that applies tm's bearer token to
+// every request before delegating to base (http.DefaultTransport if base is
+// nil). On a 401 response it invalidates the cached token and retries the
+// request once against a freshly forced refresh; concurrent requests that
+// hit a 401 on the same stale token share that single refresh instead of
+// each triggering their own (see ForceRefresh).
+//
+// Typical usage: client := &http.Client{Transport: tm.Transport(nil)}
+func (tm *TokenManager) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base, tm: tm}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.tm.EnsureValidToken(req.Context()); err != nil {
+		return nil, err
+	}
+
+	outreq := req.Clone(req.Context())
+	t.tm.ApplyToRequest(outreq)
+
+	resp, err := t.base.RoundTrip(outreq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The token looks stale to the server; invalidate it and force a single
+	// shared refresh before retrying once.
+
+	// req.Body was already drained by the first attempt. If the request has
+	// a body we have no way to replay (GetBody unset), retrying would send a
+	// corrupted or empty body, so give up and return the original response.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	t.tm.Invalidate()
+	if refreshErr := t.tm.ForceRefresh(req.Context()); refreshErr != nil {
+		return nil, fmt.Errorf("oauth: token rejected with 401 and refresh failed: %v", refreshErr)
+	}
+
+	retryReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("oauth: rewinding request body for retry: %v", err)
+		}
+		retryReq.Body = body
+	}
+	t.tm.ApplyToRequest(retryReq)
+	return t.base.RoundTrip(retryReq)
+}
+
+// Token mirrors the exported fields of golang.org/x/oauth2.Token that
+// TokenManager can populate, so TokenSource satisfies the shape of
+// oauth2.TokenSource (Token() (*oauth2.Token, error)) without this package
+// depending on golang.org/x/oauth2.
+type Token struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// TokenSource adapts a TokenManager to the shape of golang.org/x/oauth2's
+// TokenSource interface, for libraries that accept one.
+type TokenSource struct {
+	tm *TokenManager
+}
+
+// TokenSource returns a TokenSource backed by tm.
+func (tm *TokenManager) TokenSource() *TokenSource {
+	return &TokenSource{tm: tm}
+}
+
+// Token implements the oauth2.TokenSource method signature, returning tm's
+// current token.
+func (s *TokenSource) Token() (*Token, error) {
+	full := s.tm.GetFullToken()
+	if full == nil {
+		return nil, fmt.Errorf("oauth: no token available")
+	}
+
+	var expiry time.Time
+	if full.ExpiresIn > 0 {
+		issuedAt := full.IssuedAt
+		if issuedAt.IsZero() {
+			issuedAt = time.Now()
+		}
+		expiry = issuedAt.Add(time.Duration(full.ExpiresIn) * time.Second)
+	}
+
+	return &Token{
+		AccessToken:  full.AccessToken,
+		TokenType:    full.TokenType,
+		RefreshToken: full.RefreshToken,
+		Expiry:       expiry,
+	}, nil
+}